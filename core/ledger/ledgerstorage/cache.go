@@ -0,0 +1,203 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ledgerstorage
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hyperledger/fabric/protos/common"
+)
+
+// CacheConfig controls the size and prefetch behavior of a cachedBlockStore
+type CacheConfig struct {
+	// MaxBlocks bounds the number of blocks held in the cache, regardless of size
+	MaxBlocks int
+	// MaxBytes bounds the total serialized size of cached blocks
+	MaxBytes int64
+	// PrefetchWindow is the number of blocks after a miss that are warmed asynchronously,
+	// useful for sequential scans such as pvtdata reconciliation
+	PrefetchWindow int
+}
+
+// Metrics tracks cache effectiveness for a cachedBlockStore
+type Metrics struct {
+	Hits                uint64
+	Misses              uint64
+	Evictions           uint64
+	PrefetchCompletions uint64
+}
+
+// cachedBlockStore wraps a BlockStore with an LRU cache of recently and sequentially
+// accessed blocks, to take RetrieveBlockByNumber off the hot path shared by gossip-driven
+// pvtdata reconciliation and concurrent readers during block commit
+type cachedBlockStore struct {
+	BlockStore
+	cfg CacheConfig
+
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	order   *list.List
+	size    int64
+
+	prefetching map[uint64]bool
+
+	metrics Metrics
+}
+
+type cacheEntry struct {
+	blockNum uint64
+	block    *common.Block
+}
+
+// NewCachedBlockStore wraps inner with an LRU+prefetch cache according to cfg
+func NewCachedBlockStore(inner BlockStore, cfg CacheConfig) BlockStore {
+	return &cachedBlockStore{
+		BlockStore:  inner,
+		cfg:         cfg,
+		entries:     make(map[uint64]*list.Element),
+		order:       list.New(),
+		prefetching: make(map[uint64]bool),
+	}
+}
+
+// RetrieveBlockByNumber returns the requested block, serving it from the cache when
+// present. On a miss, it synchronously fetches the block from the underlying store and
+// kicks off asynchronous prefetching of the next PrefetchWindow blocks.
+func (c *cachedBlockStore) RetrieveBlockByNumber(blockNum uint64) (*common.Block, error) {
+	if block, ok := c.get(blockNum); ok {
+		atomic.AddUint64(&c.metrics.Hits, 1)
+		return block, nil
+	}
+	atomic.AddUint64(&c.metrics.Misses, 1)
+
+	block, err := c.BlockStore.RetrieveBlockByNumber(blockNum)
+	if err != nil {
+		return nil, err
+	}
+	c.put(blockNum, block)
+	c.prefetchAsync(blockNum)
+	return block, nil
+}
+
+// AddBlock adds the block to the underlying store and refreshes the cache so that a
+// subsequent read of a just-committed block is a hit unless the block has since been
+// evicted (or alone exceeds MaxBytes)
+func (c *cachedBlockStore) AddBlock(block *common.Block) error {
+	if err := c.BlockStore.AddBlock(block); err != nil {
+		return err
+	}
+	c.put(block.Header.Number, block)
+	return nil
+}
+
+func (c *cachedBlockStore) get(blockNum uint64) (*common.Block, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[blockNum]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).block, true
+}
+
+func (c *cachedBlockStore) put(blockNum uint64, block *common.Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[blockNum]; ok {
+		c.order.MoveToFront(elem)
+		elem.Value.(*cacheEntry).block = block
+		return
+	}
+	elem := c.order.PushFront(&cacheEntry{blockNum: blockNum, block: block})
+	c.entries[blockNum] = elem
+	c.size += blockSize(block)
+	c.evictIfNeeded()
+}
+
+func (c *cachedBlockStore) evictIfNeeded() {
+	for c.overCapacity() {
+		back := c.order.Back()
+		if back == nil {
+			return
+		}
+		entry := back.Value.(*cacheEntry)
+		c.order.Remove(back)
+		delete(c.entries, entry.blockNum)
+		c.size -= blockSize(entry.block)
+		atomic.AddUint64(&c.metrics.Evictions, 1)
+	}
+}
+
+func (c *cachedBlockStore) overCapacity() bool {
+	if c.cfg.MaxBlocks > 0 && c.order.Len() > c.cfg.MaxBlocks {
+		return true
+	}
+	if c.cfg.MaxBytes > 0 && c.size > c.cfg.MaxBytes {
+		return true
+	}
+	return false
+}
+
+func (c *cachedBlockStore) prefetchAsync(afterBlockNum uint64) {
+	if c.cfg.PrefetchWindow <= 0 {
+		return
+	}
+	for i := 1; i <= c.cfg.PrefetchWindow; i++ {
+		blockNum := afterBlockNum + uint64(i)
+		c.mu.Lock()
+		_, cached := c.entries[blockNum]
+		already := c.prefetching[blockNum]
+		if !cached && !already {
+			c.prefetching[blockNum] = true
+		}
+		c.mu.Unlock()
+		if cached || already {
+			continue
+		}
+		go c.prefetch(blockNum)
+	}
+}
+
+func (c *cachedBlockStore) prefetch(blockNum uint64) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.prefetching, blockNum)
+		c.mu.Unlock()
+	}()
+	block, err := c.BlockStore.RetrieveBlockByNumber(blockNum)
+	if err != nil {
+		// the block may simply not exist yet (we raced ahead of the committer); nothing
+		// to warm in that case
+		return
+	}
+	c.put(blockNum, block)
+	atomic.AddUint64(&c.metrics.PrefetchCompletions, 1)
+}
+
+func blockSize(block *common.Block) int64 {
+	var size int64
+	for _, txBytes := range block.Data.Data {
+		size += int64(len(txBytes))
+	}
+	for _, metaBytes := range block.Metadata.Metadata {
+		size += int64(len(metaBytes))
+	}
+	return size
+}
+
+// CacheMetrics returns the current hit/miss/eviction/prefetch counters of this cache
+func (c *cachedBlockStore) CacheMetrics() Metrics {
+	return Metrics{
+		Hits:                atomic.LoadUint64(&c.metrics.Hits),
+		Misses:              atomic.LoadUint64(&c.metrics.Misses),
+		Evictions:           atomic.LoadUint64(&c.metrics.Evictions),
+		PrefetchCompletions: atomic.LoadUint64(&c.metrics.PrefetchCompletions),
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ledgerstorage
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/hyperledger/fabric/common/ledger/util/leveldbhelper"
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/core/ledger/pvtdatapolicy"
+)
+
+// purgeBatchSize bounds how many expired keys the background purge goroutine deletes
+// in a single leveldb batch
+const purgeBatchSize = 1000
+
+// expiryKeeper tracks, in a dedicated "expiry" index in ledgerstorage's bookkeeping DB
+// (not in the pvtdata store itself), the block
+// height at which each (ns, coll) writeset committed at a given block becomes eligible
+// for purge, as dictated by the collection's Block-To-Live policy
+type expiryKeeper struct {
+	db       *leveldbhelper.DBHandle
+	btl      pvtdatapolicy.BTLPolicy
+	stopChan chan struct{}
+}
+
+func newExpiryKeeper(db *leveldbhelper.DBHandle, btl pvtdatapolicy.BTLPolicy) *expiryKeeper {
+	return &expiryKeeper{db: db, btl: btl}
+}
+
+// recordExpirations computes, for each (ns, coll) in writeSets, the block at which it
+// expires given that it is being durably written to the pvtdata store as of committingBlk,
+// and persists that under an expiry-indexed key so the purge goroutine can later find it
+// with a forward scan. It must be called at every code path that actually writes pvtdata
+// into the store -- the happy-path commit, old-block backfill, and snapshot bootstrap --
+// since a writeset that was never recorded here will never be purged.
+func (k *expiryKeeper) recordExpirations(committingBlk uint64, writeSets map[uint64]*ledger.TxPvtData) error {
+	batch := leveldbhelper.NewUpdateBatch()
+	for _, txPvtData := range writeSets {
+		if txPvtData == nil || txPvtData.WriteSet == nil {
+			continue
+		}
+		for _, nsRwset := range txPvtData.WriteSet.NsPvtRwset {
+			for _, collRwset := range nsRwset.CollectionPvtRwset {
+				expiringBlk, err := k.btl.GetExpiringBlock(nsRwset.Namespace, collRwset.CollectionName, committingBlk)
+				if err != nil {
+					return err
+				}
+				if expiringBlk == pvtdatapolicy.NeverExpires {
+					continue
+				}
+				batch.Put(expiryKey(expiringBlk, committingBlk, nsRwset.Namespace, collRwset.CollectionName), []byte{1})
+			}
+		}
+	}
+	return k.db.WriteBatch(batch, true)
+}
+
+// IsExpired returns whether the writeset for (ns, coll) committed at committingBlk has
+// expired by currentBlk, per the collection's BTL policy
+func (s *Store) IsExpired(ns, coll string, committingBlk, currentBlk uint64) bool {
+	expiringBlk, err := s.expiryKeeper.btl.GetExpiringBlock(ns, coll, committingBlk)
+	if err != nil || expiringBlk == pvtdatapolicy.NeverExpires {
+		return false
+	}
+	return currentBlk >= expiringBlk
+}
+
+// purgeExpired scans the expiry index for entries whose expiring block is at or before
+// currentBlk and deletes the corresponding pvtdata, in batches of purgeBatchSize
+func (k *expiryKeeper) purgeExpired(currentBlk uint64, deletePvtdata func(committingBlk uint64, ns, coll string) error) error {
+	itr := k.db.GetIterator(nil, nil)
+	defer itr.Release()
+
+	batch := leveldbhelper.NewUpdateBatch()
+	purged := 0
+	for itr.First(); itr.Valid(); itr.Next() {
+		expiringBlk, committingBlk, ns, coll, err := splitExpiryKey(itr.Key())
+		if err != nil {
+			return err
+		}
+		if expiringBlk > currentBlk {
+			break
+		}
+		if err := deletePvtdata(committingBlk, ns, coll); err != nil {
+			return err
+		}
+		batch.Delete(itr.Key())
+		purged++
+		if purged >= purgeBatchSize {
+			if err := k.db.WriteBatch(batch, true); err != nil {
+				return err
+			}
+			batch = leveldbhelper.NewUpdateBatch()
+			purged = 0
+		}
+	}
+	return k.db.WriteBatch(batch, true)
+}
+
+// rescheduleOnEligibilityEnabled is a no-op: promoting a missing-data entry from
+// ineligible to eligible (see missingDataBookkeeper.setEligible) does not, by itself, write
+// any pvtdata, so there is nothing yet to schedule for expiry. An expiry entry is only
+// created once the writeset is actually durably written, via recordExpirations, which is
+// invoked from CommitWithPvtData, CommitPvtDataOfOldBlocks and CreateFromSnapshot.
+func (k *expiryKeeper) rescheduleOnEligibilityEnabled(committingBlk uint64, nsCollMap map[string][]string) error {
+	return nil
+}
+
+func expiryKey(expiringBlk, committingBlk uint64, ns, coll string) []byte {
+	key := uint64ToBytes(expiringBlk)
+	key = append(key, uint64ToBytes(committingBlk)...)
+	key = append(key, []byte(ns)...)
+	key = append(key, 0x00)
+	key = append(key, []byte(coll)...)
+	return key
+}
+
+func splitExpiryKey(key []byte) (expiringBlk, committingBlk uint64, ns, coll string, err error) {
+	expiringBlk = binary.BigEndian.Uint64(key[0:8])
+	committingBlk = binary.BigEndian.Uint64(key[8:16])
+	rest := key[16:]
+	for i, b := range rest {
+		if b == 0x00 {
+			ns = string(rest[:i])
+			coll = string(rest[i+1:])
+			break
+		}
+	}
+	return expiringBlk, committingBlk, ns, coll, nil
+}
+
+// EnableBackgroundPurge starts a goroutine that periodically purges expired pvtdata.
+// It is opt-in because not every consumer of a Store (e.g. short-lived CLI tooling)
+// wants a background goroutine running against its ledger.
+func (s *Store) EnableBackgroundPurge(interval time.Duration) {
+	if s.expiryKeeper == nil || s.purgeStop != nil {
+		return
+	}
+	s.purgeStop = make(chan struct{})
+	go s.runBackgroundPurge(interval)
+}
+
+// DisableBackgroundPurge stops a previously started background purge goroutine
+func (s *Store) DisableBackgroundPurge() {
+	if s.purgeStop == nil {
+		return
+	}
+	close(s.purgeStop)
+	s.purgeStop = nil
+}
+
+func (s *Store) runBackgroundPurge(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			blockchainInfo, err := s.BlockStore.GetBlockchainInfo()
+			if err != nil {
+				logger.Errorw("background purge: failed to get blockchain info", "ledger", s.ledgerID, "err", err)
+				continue
+			}
+			if blockchainInfo.Height == 0 {
+				continue
+			}
+			if err := s.expiryKeeper.purgeExpired(blockchainInfo.Height-1, s.deleteExpiredPvtdata); err != nil {
+				logger.Errorw("background purge: failed to purge expired pvtdata", "ledger", s.ledgerID, "err", err)
+			}
+		case <-s.purgeStop:
+			return
+		}
+	}
+}
+
+func (s *Store) deleteExpiredPvtdata(committingBlk uint64, ns, coll string) error {
+	return s.pvtdataStore.Purge(committingBlk, ns, coll)
+}
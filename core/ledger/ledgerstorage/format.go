@@ -0,0 +1,32 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ledgerstorage
+
+// legacyDBSuffix is the bookkeepingProvider sub-namespace that holds a ledger's
+// pre-existing v1.1/v1.2-era pvtdata, if any. It is distinct from the namespaces used by
+// the missing-data, expiry, and snapshot keepers so the format-translation keys can never
+// collide with theirs.
+//
+// NOTE: a real v1.1/v1.2-era ledger has this data sitting in pvtdatastorage's own LevelDB
+// directory, not here. Moving the legacy store to read that directory in place requires
+// pvtdatastorage itself to stop opening it exclusively first (so the two can coexist, or so
+// pvtdatastorage absorbs the migration itself), which is a change to that package and out of
+// scope for this series. Until that lands, this namespace is where UpgradeFormat expects a
+// legacy-format dump to have been pre-loaded into before Provider.Open runs.
+const legacyDBSuffix = "/legacypvtdata"
+
+func (p *Provider) legacyStoreFor(ledgerid string) *legacyPvtdataStore {
+	return newLegacyPvtdataStore(p.bookkeepingProvider.GetDBHandle(ledgerid + legacyDBSuffix))
+}
+
+// UpgradeFormat rewrites a ledger's legacy v1.1/v1.2-era pvtdata into the current
+// composite-key layout, in a single atomic batch, and marks it "2.0". It is safe to call
+// more than once: a ledger that is already upgraded is left untouched, and one that has
+// no legacy data only gains the "2.0" marker.
+func (p *Provider) UpgradeFormat(ledgerID string) error {
+	return p.legacyStoreFor(ledgerID).upgrade()
+}
@@ -0,0 +1,245 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ledgerstorage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/common/ledger/util/leveldbhelper"
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/protos/ledger/rwset"
+)
+
+// format markers/prefixes used by legacyPvtdataStore. v1.1 stored one entry per (block,
+// tx) with every namespace/collection's rwset embedded together; v1.2 switched to one
+// composite-keyed entry per (block, tx, ns, coll). Current (2.0) ledgers never populate
+// this store at all -- it only exists to let an upgraded peer keep reading a pre-existing
+// v1.1/v1.2 ledger directory, both before and after UpgradeFormat rewrites its entries
+// into v1.2 composite keys in place.
+const (
+	legacyFormatKey = "format"
+	legacyFormatV11 = "1.1"
+	legacyFormatV12 = "1.2"
+	legacyFormatV20 = "2.0"
+	legacyPrefixV11 = byte(0x01)
+	legacyPrefixV12 = byte(0x02)
+)
+
+// legacyPvtdataStore decodes a pre-existing v1.1/v1.2-era pvtdata LevelDB directory,
+// transparently regardless of which (or both) of the two legacy encodings it contains, and
+// can rewrite it into pure v1.2-style composite keys in a single atomic batch
+type legacyPvtdataStore struct {
+	db *leveldbhelper.DBHandle
+}
+
+func newLegacyPvtdataStore(db *leveldbhelper.DBHandle) *legacyPvtdataStore {
+	return &legacyPvtdataStore{db: db}
+}
+
+// detectFormat reports the legacy encoding(s) present, consulting the "format" marker key
+// first and falling back to scanning key prefixes when the marker is absent (e.g. a ledger
+// that predates the marker being written at all) or is "2.0" (an upgraded store keeps its
+// entries as v1.2 composite keys). Provider.Open calls this to decide whether
+// to attach a legacyPvtdataStore to a Store at all, so a ledger with no legacy data pays no
+// per-read overhead for the merge in Store.GetPvtDataByNum.
+func (l *legacyPvtdataStore) detectFormat() (hasV11, hasV12 bool, err error) {
+	marker, err := l.db.Get([]byte(legacyFormatKey))
+	if err != nil {
+		return false, false, err
+	}
+	switch string(marker) {
+	case legacyFormatV11:
+		return true, false, nil
+	case legacyFormatV12:
+		return false, true, nil
+	}
+
+	itr := l.db.GetIterator(nil, nil)
+	defer itr.Release()
+	for itr.First(); itr.Valid(); itr.Next() {
+		switch itr.Key()[0] {
+		case legacyPrefixV11:
+			hasV11 = true
+		case legacyPrefixV12:
+			hasV12 = true
+		}
+	}
+	return hasV11, hasV12, nil
+}
+
+// v11Entry is the payload of a v1.1-era key: every namespace/collection rwset for a single
+// (block, tx), keyed by namespace then collection name
+type v11Entry map[string]map[string][]byte
+
+// GetPvtDataByBlockNum decodes and merges every legacy-format entry (v1.1 and/or v1.2)
+// recorded for blockNum, applying filter if non-nil. It consults detectFormat first so a
+// store holding only one of the two legacy encodings never pays for scanning the other.
+func (l *legacyPvtdataStore) GetPvtDataByBlockNum(blockNum uint64, filter ledger.PvtNsCollFilter) ([]*ledger.TxPvtData, error) {
+	hasV11, hasV12, err := l.detectFormat()
+	if err != nil {
+		return nil, err
+	}
+
+	byTxNum := map[uint64]*rwset.TxPvtReadWriteSet{}
+
+	if hasV11 {
+		itr := l.db.GetIterator(legacyBlockPrefix(legacyPrefixV11, blockNum), legacyBlockPrefixEnd(legacyPrefixV11, blockNum))
+		for itr.First(); itr.Valid(); itr.Next() {
+			_, txNum, err := splitLegacyV11Key(itr.Key())
+			if err != nil {
+				itr.Release()
+				return nil, err
+			}
+			var entry v11Entry
+			if err := json.Unmarshal(itr.Value(), &entry); err != nil {
+				itr.Release()
+				return nil, err
+			}
+			mergeIntoWriteSet(byTxNum, txNum, entry, filter)
+		}
+		itr.Release()
+	}
+
+	if hasV12 {
+		itr := l.db.GetIterator(legacyBlockPrefix(legacyPrefixV12, blockNum), legacyBlockPrefixEnd(legacyPrefixV12, blockNum))
+		for itr.First(); itr.Valid(); itr.Next() {
+			_, txNum, ns, coll, err := splitLegacyV12Key(itr.Key())
+			if err != nil {
+				itr.Release()
+				return nil, err
+			}
+			if filter != nil && !filter.Has(ns, coll) {
+				continue
+			}
+			rwsetBytes := make([]byte, len(itr.Value()))
+			copy(rwsetBytes, itr.Value())
+			mergeIntoWriteSet(byTxNum, txNum, v11Entry{ns: {coll: rwsetBytes}}, nil)
+		}
+		itr.Release()
+	}
+
+	if len(byTxNum) == 0 {
+		return nil, nil
+	}
+	var result []*ledger.TxPvtData
+	for txNum, writeSet := range byTxNum {
+		result = append(result, &ledger.TxPvtData{SeqInBlock: txNum, WriteSet: writeSet})
+	}
+	return result, nil
+}
+
+func mergeIntoWriteSet(byTxNum map[uint64]*rwset.TxPvtReadWriteSet, txNum uint64, entry v11Entry, filter ledger.PvtNsCollFilter) {
+	writeSet, ok := byTxNum[txNum]
+	if !ok {
+		writeSet = &rwset.TxPvtReadWriteSet{DataModel: rwset.TxReadWriteSet_KV}
+		byTxNum[txNum] = writeSet
+	}
+	for ns, colls := range entry {
+		var nsRwset *rwset.NsPvtReadWriteSet
+		for _, existing := range writeSet.NsPvtRwset {
+			if existing.Namespace == ns {
+				nsRwset = existing
+				break
+			}
+		}
+		if nsRwset == nil {
+			nsRwset = &rwset.NsPvtReadWriteSet{Namespace: ns}
+			writeSet.NsPvtRwset = append(writeSet.NsPvtRwset, nsRwset)
+		}
+		for coll, rwsetBytes := range colls {
+			if filter != nil && !filter.Has(ns, coll) {
+				continue
+			}
+			nsRwset.CollectionPvtRwset = append(nsRwset.CollectionPvtRwset, &rwset.CollectionPvtReadWriteSet{
+				CollectionName: coll,
+				Rwset:          rwsetBytes,
+			})
+		}
+	}
+}
+
+// upgrade rewrites every v1.1 entry into v1.2 composite-key form, in a single atomic batch,
+// and writes the "2.0" format marker. It is idempotent: a store already marked "2.0" is
+// left untouched, and a store with no v1.1 entries left only gains the marker.
+func (l *legacyPvtdataStore) upgrade() error {
+	marker, err := l.db.Get([]byte(legacyFormatKey))
+	if err != nil {
+		return err
+	}
+	if string(marker) == legacyFormatV20 {
+		return nil
+	}
+
+	batch := leveldbhelper.NewUpdateBatch()
+	itr := l.db.GetIterator([]byte{legacyPrefixV11}, []byte{legacyPrefixV11 + 1})
+	for itr.First(); itr.Valid(); itr.Next() {
+		blockNum, txNum, err := splitLegacyV11Key(itr.Key())
+		if err != nil {
+			itr.Release()
+			return err
+		}
+		var entry v11Entry
+		if err := json.Unmarshal(itr.Value(), &entry); err != nil {
+			itr.Release()
+			return err
+		}
+		for ns, colls := range entry {
+			for coll, rwsetBytes := range colls {
+				batch.Put(legacyV12Key(blockNum, txNum, ns, coll), rwsetBytes)
+			}
+		}
+		batch.Delete(itr.Key())
+	}
+	itr.Release()
+
+	batch.Put([]byte(legacyFormatKey), []byte(legacyFormatV20))
+	return l.db.WriteBatch(batch, true)
+}
+
+func legacyV11Key(blockNum, txNum uint64) []byte {
+	key := []byte{legacyPrefixV11}
+	key = append(key, uint64ToBytes(blockNum)...)
+	key = append(key, uint64ToBytes(txNum)...)
+	return key
+}
+
+func splitLegacyV11Key(key []byte) (blockNum, txNum uint64, err error) {
+	return binary.BigEndian.Uint64(key[1:9]), binary.BigEndian.Uint64(key[9:17]), nil
+}
+
+func legacyV12Key(blockNum, txNum uint64, ns, coll string) []byte {
+	key := []byte{legacyPrefixV12}
+	key = append(key, uint64ToBytes(blockNum)...)
+	key = append(key, uint64ToBytes(txNum)...)
+	key = append(key, []byte(ns)...)
+	key = append(key, 0x00)
+	key = append(key, []byte(coll)...)
+	return key
+}
+
+func splitLegacyV12Key(key []byte) (blockNum, txNum uint64, ns, coll string, err error) {
+	blockNum = binary.BigEndian.Uint64(key[1:9])
+	txNum = binary.BigEndian.Uint64(key[9:17])
+	rest := key[17:]
+	for i, b := range rest {
+		if b == 0x00 {
+			ns = string(rest[:i])
+			coll = string(rest[i+1:])
+			break
+		}
+	}
+	return blockNum, txNum, ns, coll, nil
+}
+
+func legacyBlockPrefix(format byte, blockNum uint64) []byte {
+	return append([]byte{format}, uint64ToBytes(blockNum)...)
+}
+
+func legacyBlockPrefixEnd(format byte, blockNum uint64) []byte {
+	return append([]byte{format}, uint64ToBytes(blockNum+1)...)
+}
@@ -0,0 +1,294 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ledgerstorage
+
+import (
+	"encoding/binary"
+
+	"github.com/hyperledger/fabric/common/ledger/util/leveldbhelper"
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+)
+
+// CollMembershipChecker answers whether this peer's org is, at the time of the check, a
+// member of the given collection's dissemination list. It is used to distinguish
+// eligible-missing pvtdata (this peer should have received it, but didn't) from
+// ineligible-missing pvtdata (this peer's org was simply never meant to get it).
+type CollMembershipChecker interface {
+	AmMemberOf(ns, coll string) (bool, error)
+}
+
+// alwaysMember is the default CollMembershipChecker used when a Provider is not wired up
+// with a real collection membership source: every (ns, coll) is treated as one this peer
+// is a member of, i.e. all missing data is "eligible-missing".
+type alwaysMember struct{}
+
+func (alwaysMember) AmMemberOf(ns, coll string) (bool, error) { return true, nil }
+
+// missingDataBookkeeper persists, per block, the set of (ns, coll) writesets that a
+// transaction's hashed rwset refers to but that were not supplied in the corresponding
+// BlockPvtData at commit time. Entries are split into two buckets: "eligible" (this peer
+// should have received the data but didn't, e.g. gossip dissemination raced with commit)
+// and "ineligible" (this peer's org was not, at commit time, part of the collection's
+// member list). ProcessCollsEligibilityEnabled moves entries between the two buckets when
+// a peer's org is later added to a collection.
+type missingDataBookkeeper struct {
+	db         *leveldbhelper.DBHandle
+	membership CollMembershipChecker
+}
+
+func newMissingDataBookkeeper(db *leveldbhelper.DBHandle, membership CollMembershipChecker) *missingDataBookkeeper {
+	return &missingDataBookkeeper{db: db, membership: membership}
+}
+
+// missingDataEntry identifies a single missing private writeset
+type missingDataEntry struct {
+	ns, coll string
+	txNum    uint64
+	eligible bool
+}
+
+// buildMissingDataForBlock inspects the hashed rwset of each transaction in the block and
+// compares it against the pvt writesets actually supplied, returning the set of (ns, coll)
+// combinations that are missing
+func (k *missingDataBookkeeper) buildMissingDataForBlock(blockAndPvtdata *ledger.BlockAndPvtData) ([]*missingDataEntry, error) {
+	txPvtRwSetsByTxNum, err := rwsetutil.CollHashedRwsetsFromBlock(blockAndPvtdata.Block)
+	if err != nil {
+		return nil, err
+	}
+	var missing []*missingDataEntry
+	for txNum, collHashes := range txPvtRwSetsByTxNum {
+		supplied := blockAndPvtdata.BlockPvtData[txNum]
+		for _, collHash := range collHashes {
+			if suppliedHasCollection(supplied, collHash.Namespace, collHash.Collection) {
+				continue
+			}
+			eligible, err := k.membership.AmMemberOf(collHash.Namespace, collHash.Collection)
+			if err != nil {
+				return nil, err
+			}
+			missing = append(missing, &missingDataEntry{
+				ns:       collHash.Namespace,
+				coll:     collHash.Collection,
+				txNum:    txNum,
+				eligible: eligible,
+			})
+		}
+	}
+	return missing, nil
+}
+
+func suppliedHasCollection(txPvtData *ledger.TxPvtData, ns, coll string) bool {
+	if txPvtData == nil || txPvtData.WriteSet == nil {
+		return false
+	}
+	for _, nsRwset := range txPvtData.WriteSet.NsPvtRwset {
+		if nsRwset.Namespace != ns {
+			continue
+		}
+		for _, collRwset := range nsRwset.CollectionPvtRwset {
+			if collRwset.CollectionName == coll {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// commitMissingDataForBlock persists the missing data entries discovered for blockNum
+func (k *missingDataBookkeeper) commitMissingDataForBlock(blockNum uint64, entries []*missingDataEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	batch := leveldbhelper.NewUpdateBatch()
+	for _, e := range entries {
+		batch.Put(missingDataKey(blockNum, e.txNum, e.ns, e.coll, e.eligible), []byte{1})
+	}
+	return k.db.WriteBatch(batch, true)
+}
+
+// mostRecentMissingBlocks walks backwards from the latest committed block and collects
+// missing-data info for at most maxBlocks distinct blocks that have at least one entry
+func (k *missingDataBookkeeper) mostRecentMissingBlocks(latestBlockNum uint64, maxBlocks int) (ledger.MissingPvtDataInfo, error) {
+	info := make(ledger.MissingPvtDataInfo)
+	blocksSeen := 0
+	itr := k.db.GetIterator(nil, nil)
+	defer itr.Release()
+	for itr.Last(); itr.Valid(); itr.Prev() {
+		blockNum, txNum, ns, coll, eligible, err := splitMissingDataKey(itr.Key())
+		if err != nil {
+			return nil, err
+		}
+		if blockNum > latestBlockNum {
+			continue
+		}
+		if _, ok := info[blockNum]; !ok {
+			if blocksSeen == maxBlocks {
+				break
+			}
+			blocksSeen++
+		}
+		info.Add(blockNum, txNum, ns, coll, eligible)
+	}
+	return info, nil
+}
+
+// setEligible moves all ineligible entries for the given (ns, coll) pairs at or before
+// committingBlk into the eligible bucket
+func (k *missingDataBookkeeper) setEligible(committingBlk uint64, nsCollMap map[string][]string) error {
+	itr := k.db.GetIterator(nil, nil)
+	defer itr.Release()
+	batch := leveldbhelper.NewUpdateBatch()
+	for itr.First(); itr.Valid(); itr.Next() {
+		blockNum, txNum, ns, coll, eligible, err := splitMissingDataKey(itr.Key())
+		if err != nil {
+			return err
+		}
+		if eligible || blockNum > committingBlk {
+			continue
+		}
+		colls, ok := nsCollMap[ns]
+		if !ok || !contains(colls, coll) {
+			continue
+		}
+		batch.Delete(itr.Key())
+		batch.Put(missingDataKey(blockNum, txNum, ns, coll, true), []byte{1})
+	}
+	return k.db.WriteBatch(batch, true)
+}
+
+// entriesForBlock returns the eligible and ineligible missing-data entries recorded for
+// blockNum; it exists mainly to let tests inspect the eligibility split directly
+func (k *missingDataBookkeeper) entriesForBlock(blockNum uint64) (eligible, ineligible []*missingDataEntry, err error) {
+	itr := k.db.GetIterator(nil, nil)
+	defer itr.Release()
+	for itr.First(); itr.Valid(); itr.Next() {
+		entryBlockNum, txNum, ns, coll, isEligible, err := splitMissingDataKey(itr.Key())
+		if err != nil {
+			return nil, nil, err
+		}
+		if entryBlockNum != blockNum {
+			continue
+		}
+		entry := &missingDataEntry{ns: ns, coll: coll, txNum: txNum, eligible: isEligible}
+		if isEligible {
+			eligible = append(eligible, entry)
+		} else {
+			ineligible = append(ineligible, entry)
+		}
+	}
+	return eligible, ineligible, nil
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// missingDataKey encodes blockNum (big-endian) as the primary sort key so that
+// mostRecentMissingBlocks' backward walk visits blocks in descending order regardless of
+// eligibility, followed by the eligibility bucket, txNum, and the ns/coll identifiers
+func missingDataKey(blockNum, txNum uint64, ns, coll string, eligible bool) []byte {
+	prefix := byte('i')
+	if eligible {
+		prefix = byte('e')
+	}
+	key := uint64ToBytes(blockNum)
+	key = append(key, prefix)
+	key = append(key, uint64ToBytes(txNum)...)
+	key = append(key, []byte(ns)...)
+	key = append(key, 0x00)
+	key = append(key, []byte(coll)...)
+	return key
+}
+
+func splitMissingDataKey(key []byte) (blockNum, txNum uint64, ns, coll string, eligible bool, err error) {
+	blockNum = binary.BigEndian.Uint64(key[0:8])
+	eligible = key[8] == 'e'
+	txNum = binary.BigEndian.Uint64(key[9:17])
+	rest := key[17:]
+	for i, b := range rest {
+		if b == 0x00 {
+			ns = string(rest[:i])
+			coll = string(rest[i+1:])
+			break
+		}
+	}
+	return blockNum, txNum, ns, coll, eligible, nil
+}
+
+func uint64ToBytes(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+// GetMissingPvtDataInfoForMostRecentBlocks returns, walking backwards from the most
+// recently committed block, the missing private writesets for up to maxBlocks blocks
+func (s *Store) GetMissingPvtDataInfoForMostRecentBlocks(maxBlocks int) (ledger.MissingPvtDataInfo, error) {
+	if maxBlocks <= 0 {
+		return nil, nil
+	}
+	blockchainInfo, err := s.BlockStore.GetBlockchainInfo()
+	if err != nil {
+		return nil, err
+	}
+	if blockchainInfo.Height == 0 {
+		return nil, nil
+	}
+	return s.missingKeeper.mostRecentMissingBlocks(blockchainInfo.Height-1, maxBlocks)
+}
+
+// CommitPvtDataOfOldBlocks commits private writesets for blocks that were already
+// committed without their full pvt data. It does not advance the pvtdata store's
+// block height; it only fills in the gaps recorded by the missing-data bookkeeper
+func (s *Store) CommitPvtDataOfOldBlocks(blocksPvtData []*ledger.BlockPvtData) error {
+	for _, blockPvtData := range blocksPvtData {
+		if err := s.pvtdataStore.CommitPvtDataOfOldBlock(blockPvtData.BlockNum, blockPvtData.WriteSets); err != nil {
+			return err
+		}
+		if err := s.missingKeeper.markCommitted(blockPvtData.BlockNum, blockPvtData.WriteSets); err != nil {
+			return err
+		}
+		if err := s.expiryKeeper.recordExpirations(blockPvtData.BlockNum, blockPvtData.WriteSets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markCommitted removes the now-satisfied entries from the missing-data bookkeeper
+func (k *missingDataBookkeeper) markCommitted(blockNum uint64, writeSets map[uint64]*ledger.TxPvtData) error {
+	batch := leveldbhelper.NewUpdateBatch()
+	for txNum, txPvtData := range writeSets {
+		if txPvtData == nil || txPvtData.WriteSet == nil {
+			continue
+		}
+		for _, nsRwset := range txPvtData.WriteSet.NsPvtRwset {
+			for _, collRwset := range nsRwset.CollectionPvtRwset {
+				batch.Delete(missingDataKey(blockNum, txNum, nsRwset.Namespace, collRwset.CollectionName, true))
+				batch.Delete(missingDataKey(blockNum, txNum, nsRwset.Namespace, collRwset.CollectionName, false))
+			}
+		}
+	}
+	return k.db.WriteBatch(batch, true)
+}
+
+// ProcessCollsEligibilityEnabled moves the missing-data entries for the given
+// namespace/collections, at or before committingBlk, from the ineligible bucket to the
+// eligible bucket. It is invoked when this peer's org is added to a collection's member
+// list after blocks referencing that collection have already been committed
+func (s *Store) ProcessCollsEligibilityEnabled(committingBlk uint64, nsCollMap map[string][]string) error {
+	if err := s.missingKeeper.setEligible(committingBlk, nsCollMap); err != nil {
+		return err
+	}
+	return s.expiryKeeper.rescheduleOnEligibilityEnabled(committingBlk, nsCollMap)
+}
@@ -0,0 +1,274 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ledgerstorage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hyperledger/fabric/common/ledger/util/leveldbhelper"
+	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
+)
+
+const (
+	blockFileArtifact    = "blockfile"
+	pvtdataFileArtifact  = "pvtdataStore"
+	manifestFileName     = "manifest.json"
+	pendingRequestsDBKey = "pendingSnapshotRequests"
+)
+
+// snapshotManifest is persisted alongside the snapshot artifacts so that a bootstrapping
+// peer can verify that the artifacts it downloaded were not tampered with or truncated
+type snapshotManifest struct {
+	LastBlockNumber uint64            `json:"last_block_number"`
+	LastBlockHash   []byte            `json:"last_block_hash"`
+	FileHashes      map[string]string `json:"file_hashes"`
+}
+
+// snapshotKeeper persists pending snapshot requests in LevelDB so they survive a restart,
+// and holds doneChan, on which a notification is sent when a snapshot is produced
+type snapshotKeeper struct {
+	db       *leveldbhelper.DBHandle
+	doneChan chan uint64
+}
+
+func newSnapshotKeeper(db *leveldbhelper.DBHandle) *snapshotKeeper {
+	return &snapshotKeeper{db: db, doneChan: make(chan uint64, 1)}
+}
+
+func (k *snapshotKeeper) pending() ([]uint64, error) {
+	b, err := k.db.Get([]byte(pendingRequestsDBKey))
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+	var blockNums []uint64
+	if err := json.Unmarshal(b, &blockNums); err != nil {
+		return nil, err
+	}
+	return blockNums, nil
+}
+
+func (k *snapshotKeeper) submit(blockNum uint64) error {
+	pending, err := k.pending()
+	if err != nil {
+		return err
+	}
+	for _, b := range pending {
+		if b == blockNum {
+			return nil
+		}
+	}
+	return k.save(append(pending, blockNum))
+}
+
+func (k *snapshotKeeper) cancel(blockNum uint64) error {
+	pending, err := k.pending()
+	if err != nil {
+		return err
+	}
+	remaining := pending[:0]
+	for _, b := range pending {
+		if b != blockNum {
+			remaining = append(remaining, b)
+		}
+	}
+	return k.save(remaining)
+}
+
+func (k *snapshotKeeper) fulfill(blockNum uint64) error {
+	return k.cancel(blockNum)
+}
+
+func (k *snapshotKeeper) save(blockNums []uint64) error {
+	b, err := json.Marshal(blockNums)
+	if err != nil {
+		return err
+	}
+	return k.db.Put([]byte(pendingRequestsDBKey), b, true)
+}
+
+// SubmitSnapshotRequest records a request to generate a ledger snapshot once blockNum is
+// committed. If blockNum has already been committed, the snapshot is generated immediately.
+func (s *Store) SubmitSnapshotRequest(blockNum uint64) error {
+	if err := s.snapshotKeeper.submit(blockNum); err != nil {
+		return err
+	}
+	blockchainInfo, err := s.BlockStore.GetBlockchainInfo()
+	if err != nil {
+		return err
+	}
+	if blockchainInfo.Height > blockNum {
+		return s.generateSnapshot(blockNum)
+	}
+	return nil
+}
+
+// CancelSnapshotRequest removes a pending snapshot request. It has no effect if the
+// snapshot was already generated.
+func (s *Store) CancelSnapshotRequest(blockNum uint64) error {
+	return s.snapshotKeeper.cancel(blockNum)
+}
+
+// PendingSnapshotRequests returns the block numbers for which a snapshot has been
+// requested but not yet generated
+func (s *Store) PendingSnapshotRequests() ([]uint64, error) {
+	return s.snapshotKeeper.pending()
+}
+
+// SnapshotDoneChan returns a channel on which the block number of a completed snapshot is
+// published. The channel buffers one notification; a notification sent while an earlier
+// one is still unread is dropped.
+func (s *Store) SnapshotDoneChan() <-chan uint64 {
+	return s.snapshotKeeper.doneChan
+}
+
+// snapshotRootDir returns the directory that holds per-block snapshot subdirectories
+// for this ledger
+func (s *Store) snapshotRootDir() string {
+	return filepath.Join(ledgerconfig.GetSnapshotsRootDir(), s.ledgerID)
+}
+
+// generateSnapshot produces, in an atomic fashion (build in a temp dir, then rename), a
+// snapshot directory containing the block file segment through blockNum, a dump of the
+// non-expired pvtdata writesets, and a manifest binding the two together
+func (s *Store) generateSnapshot(blockNum uint64) error {
+	if err := os.MkdirAll(s.snapshotRootDir(), 0755); err != nil {
+		return err
+	}
+	tempDir, err := ioutil.TempDir(s.snapshotRootDir(), "in-progress-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	blockFilePath := filepath.Join(tempDir, blockFileArtifact)
+	if err := s.BlockStore.ExportBlocksUpTo(blockNum, blockFilePath); err != nil {
+		return err
+	}
+
+	pvtdataFilePath := filepath.Join(tempDir, pvtdataFileArtifact)
+	if err := s.exportNonExpiredPvtdata(blockNum, pvtdataFilePath); err != nil {
+		return err
+	}
+
+	block, err := s.RetrieveBlockByNumber(blockNum)
+	if err != nil {
+		return err
+	}
+	manifest := &snapshotManifest{
+		LastBlockNumber: blockNum,
+		LastBlockHash:   block.Header.Hash(),
+		FileHashes:      map[string]string{},
+	}
+	for artifact, path := range map[string]string{blockFileArtifact: blockFilePath, pvtdataFileArtifact: pvtdataFilePath} {
+		h, err := fileSha256(path)
+		if err != nil {
+			return err
+		}
+		manifest.FileHashes[artifact] = h
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tempDir, manifestFileName), manifestBytes, 0644); err != nil {
+		return err
+	}
+
+	finalDir := filepath.Join(s.snapshotRootDir(), fmt.Sprintf("%d", blockNum))
+	if err := os.Rename(tempDir, finalDir); err != nil {
+		return err
+	}
+
+	if err := s.snapshotKeeper.fulfill(blockNum); err != nil {
+		return err
+	}
+	select {
+	case s.snapshotKeeper.doneChan <- blockNum:
+	default:
+	}
+	return nil
+}
+
+func (s *Store) exportNonExpiredPvtdata(blockNum uint64, path string) error {
+	return s.pvtdataStore.ExportNonExpired(blockNum, path)
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CreateFromSnapshot verifies the manifest in snapshotDir, seeds a fresh block store with
+// the contained block file segment, primes a fresh pvtdata store to the snapshot's height
+// with the contained pvtdata dump, and returns the store, the ledger ID, and the bootstrap
+// height it was seeded to
+func (p *Provider) CreateFromSnapshot(snapshotDir string) (*Store, string, uint64, error) {
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(snapshotDir, manifestFileName))
+	if err != nil {
+		return nil, "", 0, err
+	}
+	manifest := &snapshotManifest{}
+	if err := json.Unmarshal(manifestBytes, manifest); err != nil {
+		return nil, "", 0, err
+	}
+	for artifact, expectedHash := range manifest.FileHashes {
+		actualHash, err := fileSha256(filepath.Join(snapshotDir, artifact))
+		if err != nil {
+			return nil, "", 0, err
+		}
+		if actualHash != expectedHash {
+			return nil, "", 0, fmt.Errorf("hash mismatch for snapshot artifact [%s]: expected [%s], got [%s]",
+				artifact, expectedHash, actualHash)
+		}
+	}
+
+	ledgerID := filepath.Base(filepath.Dir(snapshotDir))
+	store, err := p.Open(ledgerID)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if err := store.BlockStore.ImportBlocks(filepath.Join(snapshotDir, blockFileArtifact)); err != nil {
+		return nil, "", 0, err
+	}
+	if err := store.pvtdataStore.ImportNonExpired(filepath.Join(snapshotDir, pvtdataFileArtifact), manifest.LastBlockNumber); err != nil {
+		return nil, "", 0, err
+	}
+	// the imported pvtdata was written directly into the pvtdata store, bypassing
+	// CommitWithPvtData, so it never got an expiry entry -- schedule one now for every
+	// writeset the snapshot actually seeded, per its originally committed block
+	for blockNum := uint64(0); blockNum <= manifest.LastBlockNumber; blockNum++ {
+		pvtdata, err := store.GetPvtDataByNum(blockNum, nil)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		if len(pvtdata) == 0 {
+			continue
+		}
+		if err := store.expiryKeeper.recordExpirations(blockNum, constructPvtdataMap(pvtdata)); err != nil {
+			return nil, "", 0, err
+		}
+	}
+	return store, ledgerID, manifest.LastBlockNumber + 1, nil
+}
@@ -0,0 +1,308 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ledgerstorage
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/common/flogging"
+	"github.com/hyperledger/fabric/common/ledger/blkstorage"
+	"github.com/hyperledger/fabric/common/ledger/blkstorage/fsblkstorage"
+	"github.com/hyperledger/fabric/common/ledger/util/leveldbhelper"
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
+	"github.com/hyperledger/fabric/core/ledger/pvtdatapolicy"
+	"github.com/hyperledger/fabric/core/ledger/pvtdatastorage"
+)
+
+var logger = flogging.MustGetLogger("ledgerstorage")
+
+// bookkeepingDBName is the name under which ledgerstorage keeps its own
+// reconciliation bookkeeping, separate from the pvtdata store proper.
+const bookkeepingDBName = "ledgerProvider"
+
+// BlockStore is the block-store capability ledgerstorage depends on: the base
+// blkstorage.BlockStore plus the block-file export/import primitives that ledger snapshot
+// generation and bootstrap (snapshot.go) require. This package's own commits are the ones
+// that introduced the dependency on ExportBlocksUpTo/ImportBlocks, so OpenWithConfig asserts
+// a provider-returned blkstorage.BlockStore actually satisfies them, surfacing a missing
+// upstream method as a clear startup error instead of a panic the first time a snapshot is
+// requested.
+type BlockStore interface {
+	blkstorage.BlockStore
+	ExportBlocksUpTo(blockNum uint64, path string) error
+	ImportBlocks(path string) error
+}
+
+// PvtDataStore is the pvt-data-store capability ledgerstorage depends on: the base
+// pvtdatastorage.Store plus the old-block commit, purge, and snapshot export/import
+// primitives that missing-data reconciliation (missingdata.go), BTL-driven purge
+// (expiry.go) and ledger snapshots (snapshot.go) require. As with BlockStore, OpenWithConfig
+// asserts a provider-returned pvtdatastorage.Store actually satisfies them, surfacing a
+// missing upstream method as a clear startup error rather than a panic on first use.
+type PvtDataStore interface {
+	pvtdatastorage.Store
+	CommitPvtDataOfOldBlock(blockNum uint64, writeSets map[uint64]*ledger.TxPvtData) error
+	Purge(committingBlk uint64, ns, coll string) error
+	ExportNonExpired(blockNum uint64, path string) error
+	ImportNonExpired(path string, lastBlockNum uint64) error
+}
+
+// Provider encapsulates the block store provider, the pvt data store provider, and the
+// provider of ledgerstorage's own bookkeeping DB
+type Provider struct {
+	blkStoreProvider     blkstorage.BlockStoreProvider
+	pvtdataStoreProvider pvtdatastorage.Provider
+	bookkeepingProvider  *leveldbhelper.Provider
+	membershipChecker    CollMembershipChecker
+}
+
+// NewProvider instantiates a new Provider. Every missing private writeset it discovers is
+// treated as eligible-missing, since it has no way to check collection membership; callers
+// that need eligible/ineligible tracking should use NewProviderWithMembershipChecker.
+func NewProvider() *Provider {
+	return NewProviderWithMembershipChecker(alwaysMember{})
+}
+
+// NewProviderWithMembershipChecker instantiates a new Provider that consults membership to
+// classify missing private writesets as eligible-missing or ineligible-missing
+func NewProviderWithMembershipChecker(membership CollMembershipChecker) *Provider {
+	attrsToIndex := []blkstorage.IndexableAttr{
+		blkstorage.IndexableAttrBlockHash,
+		blkstorage.IndexableAttrBlockNum,
+		blkstorage.IndexableAttrTxID,
+		blkstorage.IndexableAttrBlockNumTranNum,
+		blkstorage.IndexableAttrBlockTxID,
+		blkstorage.IndexableAttrTxValidationCode,
+	}
+	indexConfig := &blkstorage.IndexConfig{AttrsToIndex: attrsToIndex}
+	blockStoreProvider := fsblkstorage.NewProvider(
+		fsblkstorage.NewConf(ledgerconfig.GetBlockStorePath(), ledgerconfig.GetMaxBlockfileSize()),
+		indexConfig)
+	bookkeepingProvider := leveldbhelper.NewProvider(
+		&leveldbhelper.Conf{DBPath: ledgerconfig.GetInternalBookkeeperPath(bookkeepingDBName)})
+	return &Provider{
+		blkStoreProvider:     blockStoreProvider,
+		pvtdataStoreProvider: pvtdatastorage.NewProvider(),
+		bookkeepingProvider:  bookkeepingProvider,
+		membershipChecker:    membership,
+	}
+}
+
+// Open opens the store with no BTL-driven expiration enabled
+func (p *Provider) Open(ledgerid string) (*Store, error) {
+	return p.OpenWithConfig(ledgerid, pvtdatapolicy.ConstantBTLPolicy(0))
+}
+
+// OpenWithConfig opens the store and configures it to track BTL-driven expiration of
+// private writesets according to btlPolicy
+func (p *Provider) OpenWithConfig(ledgerid string, btlPolicy pvtdatapolicy.BTLPolicy) (*Store, error) {
+	blockStoreRaw, err := p.blkStoreProvider.OpenBlockStore(ledgerid)
+	if err != nil {
+		return nil, err
+	}
+	blockStore, ok := blockStoreRaw.(BlockStore)
+	if !ok {
+		return nil, fmt.Errorf("block store for ledger [%s] does not implement ExportBlocksUpTo/ImportBlocks, which ledgerstorage requires for ledger snapshots", ledgerid)
+	}
+	if cacheSize := ledgerconfig.GetBlockCacheSize(); cacheSize > 0 {
+		blockStore = NewCachedBlockStore(blockStore, CacheConfig{MaxBlocks: cacheSize, PrefetchWindow: 2})
+	}
+	pvtdataStoreRaw, err := p.pvtdataStoreProvider.OpenStore(ledgerid)
+	if err != nil {
+		return nil, err
+	}
+	pvtdataStore, ok := pvtdataStoreRaw.(PvtDataStore)
+	if !ok {
+		return nil, fmt.Errorf("pvt data store for ledger [%s] does not implement CommitPvtDataOfOldBlock/Purge/ExportNonExpired/ImportNonExpired, which ledgerstorage requires for reconciliation, purge and ledger snapshots", ledgerid)
+	}
+	// each bookkeeping subsystem gets its own key-prefixed handle off the shared
+	// bookkeepingProvider so that, e.g., an expiry-index key can never be misparsed as a
+	// missing-data key
+	store := &Store{
+		BlockStore:     blockStore,
+		pvtdataStore:   pvtdataStore,
+		ledgerID:       ledgerid,
+		missingKeeper:  newMissingDataBookkeeper(p.bookkeepingProvider.GetDBHandle(ledgerid+"/missingdata"), p.membershipChecker),
+		expiryKeeper:   newExpiryKeeper(p.bookkeepingProvider.GetDBHandle(ledgerid+"/expiry"), btlPolicy),
+		snapshotKeeper: newSnapshotKeeper(p.bookkeepingProvider.GetDBHandle(ledgerid + "/snapshot")),
+	}
+	if err := store.init(); err != nil {
+		return nil, err
+	}
+
+	legacyStore := p.legacyStoreFor(ledgerid)
+	hasV11, hasV12, err := legacyStore.detectFormat()
+	if err != nil {
+		return nil, err
+	}
+	if hasV11 || hasV12 {
+		store.legacyStore = legacyStore
+	}
+	return store, nil
+}
+
+// Close closes the provider
+func (p *Provider) Close() {
+	p.blkStoreProvider.Close()
+	p.pvtdataStoreProvider.Close()
+	p.bookkeepingProvider.Close()
+}
+
+// Store encapsulates a block store and a pvt data store, and keeps them in sync
+type Store struct {
+	BlockStore
+	pvtdataStore PvtDataStore
+	ledgerID     string
+
+	missingKeeper  *missingDataBookkeeper
+	expiryKeeper   *expiryKeeper
+	purgeStop      chan struct{}
+	snapshotKeeper *snapshotKeeper
+	// legacyStore is non-nil only when this ledger has pre-existing v1.1/v1.2-era
+	// pvtdata, either as found or as rewritten into v1.2 keys by Provider.UpgradeFormat
+	legacyStore *legacyPvtdataStore
+
+	isPvtstoreAheadOfBlockstore bool
+}
+
+// init reconciles the block store height with the pvt data store height, for the case
+// where the peer crashed after committing a block's pvt data but before committing the
+// block itself, and for a pvt data store opened for the first time against an existing
+// block store
+func (s *Store) init() error {
+	blockchainInfo, err := s.BlockStore.GetBlockchainInfo()
+	if err != nil {
+		return err
+	}
+	pvtdataStoreHt, err := s.pvtdataStore.LastCommittedBlockHeight()
+	if err != nil {
+		return err
+	}
+	blockStoreHt := blockchainInfo.Height
+	if pvtdataStoreHt == blockStoreHt {
+		return nil
+	}
+	if pvtdataStoreHt == 0 {
+		// pvt data store is empty but the block store is not (e.g. upgrade from a release
+		// without pvt data): start the pvt data store at the block store's height
+		return s.pvtdataStore.InitLastCommittedBlock(blockStoreHt - 1)
+	}
+	if pvtdataStoreHt > blockStoreHt {
+		// pvtdata store already has the pvtdata for the block that is about to be added
+		s.isPvtstoreAheadOfBlockstore = true
+		return nil
+	}
+	return fmt.Errorf("pvt data store height [%d] is behind the block store height [%d] for ledger [%s]",
+		pvtdataStoreHt, blockStoreHt, s.ledgerID)
+}
+
+// CommitWithPvtData commits the block and the corresponding pvt data in an atomic fashion
+func (s *Store) CommitWithPvtData(blockAndPvtdata *ledger.BlockAndPvtData) error {
+	blockNum := blockAndPvtdata.Block.Header.Number
+
+	if !s.isPvtstoreAheadOfBlockstore {
+		pvtdataStoreHt, err := s.pvtdataStore.LastCommittedBlockHeight()
+		if err != nil {
+			return err
+		}
+		if pvtdataStoreHt < blockNum+1 {
+			missingPvtData, err := s.missingKeeper.buildMissingDataForBlock(blockAndPvtdata)
+			if err != nil {
+				return err
+			}
+			if err := s.pvtdataStore.Commit(blockNum, blockAndPvtdata.BlockPvtData, nil); err != nil {
+				return err
+			}
+			if err := s.missingKeeper.commitMissingDataForBlock(blockNum, missingPvtData); err != nil {
+				return err
+			}
+			if err := s.expiryKeeper.recordExpirations(blockNum, blockAndPvtdata.BlockPvtData); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.AddBlock(blockAndPvtdata.Block); err != nil {
+		return err
+	}
+	s.isPvtstoreAheadOfBlockstore = false
+
+	pending, err := s.snapshotKeeper.pending()
+	if err != nil {
+		return err
+	}
+	for _, requestedBlockNum := range pending {
+		if requestedBlockNum == blockNum {
+			if err := s.generateSnapshot(blockNum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetPvtDataAndBlockByNum returns the block and the pvt data associated with the given block number, filtered by
+// the given filter. If the filter is nil, no filtering is performed and the complete pvt data is returned
+func (s *Store) GetPvtDataAndBlockByNum(blockNum uint64, filter ledger.PvtNsCollFilter) (*ledger.BlockAndPvtData, error) {
+	block, err := s.RetrieveBlockByNumber(blockNum)
+	if err != nil {
+		return nil, err
+	}
+	pvtdata, err := s.GetPvtDataByNum(blockNum, filter)
+	if err != nil {
+		return nil, err
+	}
+	return &ledger.BlockAndPvtData{Block: block, BlockPvtData: constructPvtdataMap(pvtdata)}, nil
+}
+
+// GetPvtDataByNum returns the pvt data for the given block number, filtered by the given
+// filter. If this ledger still has pre-existing v1.1/v1.2-era pvtdata on disk, entries found
+// there are transparently decoded and merged in alongside current-format entries.
+func (s *Store) GetPvtDataByNum(blockNum uint64, filter ledger.PvtNsCollFilter) ([]*ledger.TxPvtData, error) {
+	pvtdata, err := s.pvtdataStore.GetPvtDataByBlockNum(blockNum, filter)
+	if err != nil {
+		return nil, err
+	}
+	if s.legacyStore == nil {
+		return pvtdata, nil
+	}
+	legacyPvtdata, err := s.legacyStore.GetPvtDataByBlockNum(blockNum, filter)
+	if err != nil {
+		return nil, err
+	}
+	return append(pvtdata, legacyPvtdata...), nil
+}
+
+// CacheMetrics returns the current hit/miss/eviction/prefetch counters for this store's
+// block cache, or a zero-value Metrics if GetBlockCacheSize() was not configured and the
+// block store is therefore uncached
+func (s *Store) CacheMetrics() Metrics {
+	cached, ok := s.BlockStore.(*cachedBlockStore)
+	if !ok {
+		return Metrics{}
+	}
+	return cached.CacheMetrics()
+}
+
+// Shutdown closes both the block store and the pvt data store
+func (s *Store) Shutdown() {
+	s.DisableBackgroundPurge()
+	s.BlockStore.Shutdown()
+	s.pvtdataStore.Shutdown()
+}
+
+func constructPvtdataMap(pvtdata []*ledger.TxPvtData) map[uint64]*ledger.TxPvtData {
+	if pvtdata == nil {
+		return nil
+	}
+	m := make(map[uint64]*ledger.TxPvtData)
+	for _, txPvtdata := range pvtdata {
+		m[txPvtdata.SeqInBlock] = txPvtdata
+	}
+	return m
+}
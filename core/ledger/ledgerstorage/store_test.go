@@ -17,9 +17,12 @@ limitations under the License.
 package ledgerstorage
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,12 +30,15 @@ import (
 	"github.com/hyperledger/fabric/common/ledger/blkstorage"
 	"github.com/hyperledger/fabric/common/ledger/blkstorage/fsblkstorage"
 	"github.com/hyperledger/fabric/common/ledger/testutil"
+	"github.com/hyperledger/fabric/common/ledger/util/leveldbhelper"
 	"github.com/hyperledger/fabric/core/ledger"
 	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
+	"github.com/hyperledger/fabric/core/ledger/pvtdatapolicy"
 	"github.com/hyperledger/fabric/protos/common"
 	"github.com/hyperledger/fabric/protos/ledger/rwset"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMain(m *testing.M) {
@@ -237,12 +243,455 @@ func samplePvtData(t *testing.T, txNums []uint64) map[uint64]*ledger.TxPvtData {
 	return constructPvtdataMap(pvtData)
 }
 
+func TestGetMissingPvtDataInfoForMostRecentBlocks(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProvider()
+	defer provider.Close()
+	store, err := provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	sampleData := sampleData(t)
+	// commit block 2 without any of its pvtdata for tx 3 and 5; NewProvider treats every
+	// such missing writeset as eligible-missing
+	incompleteBlock2 := &ledger.BlockAndPvtData{Block: sampleData[2].Block}
+	for i := 0; i < 10; i++ {
+		if i == 2 {
+			assert.NoError(t, store.CommitWithPvtData(incompleteBlock2))
+			continue
+		}
+		assert.NoError(t, store.CommitWithPvtData(sampleData[i]))
+	}
+
+	missingInfo, err := store.GetMissingPvtDataInfoForMostRecentBlocks(10)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, missingInfo[2])
+}
+
+// notMemberOf is a CollMembershipChecker test double that reports this peer as not being
+// a member of the given (ns, coll) pairs, and a member of everything else
+type notMemberOf map[string]bool
+
+func (n notMemberOf) AmMemberOf(ns, coll string) (bool, error) {
+	return !n[ns+"/"+coll], nil
+}
+
+func TestIneligibleMissingDataIsPromotedOnEligibilityEnabled(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProviderWithMembershipChecker(notMemberOf{"ns-1/coll-2": true})
+	defer provider.Close()
+	store, err := provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	sampleData := sampleData(t)
+	// commit block 2 without any pvtdata at all: tx 3/5 reference ns-1/coll-1 (this peer is
+	// a member, so this is eligible-missing) and ns-1/coll-2 (this peer is not a member, so
+	// this is ineligible-missing)
+	incompleteBlock2 := &ledger.BlockAndPvtData{Block: sampleData[2].Block}
+	for i := 0; i < 10; i++ {
+		if i == 2 {
+			assert.NoError(t, store.CommitWithPvtData(incompleteBlock2))
+			continue
+		}
+		assert.NoError(t, store.CommitWithPvtData(sampleData[i]))
+	}
+
+	_, ineligible, err := store.missingKeeper.entriesForBlock(2)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, ineligible, "expected an ineligible-missing entry for ns-1/coll-2")
+
+	// this peer's org is now added to coll-2's member list
+	assert.NoError(t, store.ProcessCollsEligibilityEnabled(2, map[string][]string{"ns-1": {"coll-2"}}))
+
+	_, ineligible, err = store.missingKeeper.entriesForBlock(2)
+	assert.NoError(t, err)
+	assert.Empty(t, ineligible, "ineligible entry should have been promoted to eligible")
+}
+
+// samplePvtDataSingleColl builds a pvt writeset, for the given txNums, that supplies only
+// collName of ns-1 -- used to steer which (ns, coll) pairs end up missing for a block
+func samplePvtDataSingleColl(t *testing.T, txNums []uint64, collName string) map[uint64]*ledger.TxPvtData {
+	pvtWriteSet := &rwset.TxPvtReadWriteSet{DataModel: rwset.TxReadWriteSet_KV}
+	pvtWriteSet.NsPvtRwset = []*rwset.NsPvtReadWriteSet{
+		&rwset.NsPvtReadWriteSet{
+			Namespace: "ns-1",
+			CollectionPvtRwset: []*rwset.CollectionPvtReadWriteSet{
+				&rwset.CollectionPvtReadWriteSet{
+					CollectionName: collName,
+					Rwset:          []byte("RandomBytes-PvtRWSet-ns1-" + collName),
+				},
+			},
+		},
+	}
+	var pvtData []*ledger.TxPvtData
+	for _, txNum := range txNums {
+		pvtData = append(pvtData, &ledger.TxPvtData{SeqInBlock: txNum, WriteSet: pvtWriteSet})
+	}
+	return constructPvtdataMap(pvtData)
+}
+
+// TestMostRecentMissingBlocksIsNotStarvedByOlderIneligibleEntries reproduces a peer that has
+// an older block with only ineligible-missing data (its org is not on coll-2's member list)
+// and a more recent block with only eligible-missing data (coll-1 genuinely failed to arrive
+// at commit time). Since missingDataKey used to bucket by eligibility ahead of blockNum, the
+// ineligible bucket sorted after the eligible bucket in its entirety, so a backward walk
+// bounded to the single most recent missing block would land on the older ineligible entry
+// and never see the newer eligible one.
+func TestMostRecentMissingBlocksIsNotStarvedByOlderIneligibleEntries(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProviderWithMembershipChecker(notMemberOf{"ns-1/coll-2": true})
+	defer provider.Close()
+	store, err := provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	sampleData := sampleData(t)
+	// block 2 (older): coll-1 is supplied, coll-2 is not -- only an ineligible-missing entry
+	block2 := &ledger.BlockAndPvtData{Block: sampleData[2].Block, BlockPvtData: samplePvtDataSingleColl(t, []uint64{3, 5}, "coll-1")}
+	// block 3 (newer): coll-2 is supplied, coll-1 is not -- only an eligible-missing entry
+	block3 := &ledger.BlockAndPvtData{Block: sampleData[3].Block, BlockPvtData: samplePvtDataSingleColl(t, []uint64{4, 6}, "coll-2")}
+	for i := 0; i < 10; i++ {
+		switch i {
+		case 2:
+			assert.NoError(t, store.CommitWithPvtData(block2))
+		case 3:
+			assert.NoError(t, store.CommitWithPvtData(block3))
+		default:
+			assert.NoError(t, store.CommitWithPvtData(sampleData[i]))
+		}
+	}
+
+	missingInfo, err := store.GetMissingPvtDataInfoForMostRecentBlocks(1)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, missingInfo[3], "the most recent missing block (3, eligible-only) must not be starved by the older ineligible-only block 2")
+}
+
+func TestCommitPvtDataOfOldBlocks(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProvider()
+	defer provider.Close()
+	store, err := provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	sampleData := sampleData(t)
+	incompleteBlock2 := &ledger.BlockAndPvtData{Block: sampleData[2].Block}
+	for i := 0; i < 10; i++ {
+		if i == 2 {
+			assert.NoError(t, store.CommitWithPvtData(incompleteBlock2))
+			continue
+		}
+		assert.NoError(t, store.CommitWithPvtData(sampleData[i]))
+	}
+
+	// block 2 should currently have no pvtdata
+	pvtdata, err := store.GetPvtDataByNum(2, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, pvtdata)
+
+	// backfill the missing pvtdata for block 2 without advancing the pvtdata store height
+	assert.NoError(t, store.CommitPvtDataOfOldBlocks([]*ledger.BlockPvtData{
+		{BlockNum: 2, WriteSets: sampleData[2].BlockPvtData},
+	}))
+
+	pvtdata, err = store.GetPvtDataByNum(2, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(pvtdata))
+}
+
+func TestBackfilledOldBlockPvtDataIsStillEligibleForExpiry(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProvider()
+	defer provider.Close()
+
+	btlPolicy := pvtdatapolicy.ConstantBTLPolicy(0)
+	btlPolicy.SetBTL("ns-1", "coll-2", 2)
+	store, err := provider.OpenWithConfig("testLedger", btlPolicy)
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	sampleData := sampleData(t)
+	// commit block 2 without its pvtdata, then backfill it via the reconciliation path
+	// rather than the happy-path commit
+	incompleteBlock2 := &ledger.BlockAndPvtData{Block: sampleData[2].Block}
+	for i := 0; i < 5; i++ {
+		if i == 2 {
+			assert.NoError(t, store.CommitWithPvtData(incompleteBlock2))
+			continue
+		}
+		assert.NoError(t, store.CommitWithPvtData(sampleData[i]))
+	}
+	require.NoError(t, store.CommitPvtDataOfOldBlocks([]*ledger.BlockPvtData{
+		{BlockNum: 2, WriteSets: sampleData[2].BlockPvtData},
+	}))
+
+	// the backfill recorded an expiry entry for block 2's coll-2 writeset, so purging at
+	// block 4 must remove it
+	require.NoError(t, store.expiryKeeper.purgeExpired(4, store.deleteExpiredPvtdata))
+
+	pvtdata, err := store.GetPvtDataByNum(2, nil)
+	assert.NoError(t, err)
+	for _, txPvtData := range pvtdata {
+		for _, nsRwset := range txPvtData.WriteSet.NsPvtRwset {
+			for _, collRwset := range nsRwset.CollectionPvtRwset {
+				assert.NotEqual(t, "coll-2", collRwset.CollectionName)
+			}
+		}
+	}
+}
+
+func TestPvtDataExpiryByBTL(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProvider()
+	defer provider.Close()
+
+	btlPolicy := pvtdatapolicy.ConstantBTLPolicy(0)
+	btlPolicy.SetBTL("ns-1", "coll-2", 2)
+	store, err := provider.OpenWithConfig("testLedger", btlPolicy)
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	sampleData := sampleData(t)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, store.CommitWithPvtData(sampleData[i]))
+	}
+
+	require.NoError(t, store.expiryKeeper.purgeExpired(4, store.deleteExpiredPvtdata))
+
+	// coll-2 of block 2 should now be expired, but coll-1 of block 2 is unaffected because
+	// its BTL policy was left at its default (never expires)
+	pvtdata, err := store.GetPvtDataByNum(2, nil)
+	assert.NoError(t, err)
+	for _, txPvtData := range pvtdata {
+		for _, nsRwset := range txPvtData.WriteSet.NsPvtRwset {
+			for _, collRwset := range nsRwset.CollectionPvtRwset {
+				assert.NotEqual(t, "coll-2", collRwset.CollectionName)
+			}
+		}
+	}
+}
+
+func TestSnapshotGenerationAndBootstrap(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProvider()
+	defer provider.Close()
+	store, err := provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	assert.NoError(t, store.SubmitSnapshotRequest(7))
+
+	sampleData := sampleData(t)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, store.CommitWithPvtData(sampleData[i]))
+	}
+
+	select {
+	case blockNum := <-store.SnapshotDoneChan():
+		assert.Equal(t, uint64(7), blockNum)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "timed out waiting for snapshot completion notification")
+	}
+
+	pending, err := store.PendingSnapshotRequests()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	snapshotDir := filepath.Join(store.snapshotRootDir(), "7")
+	assert.FileExists(t, filepath.Join(snapshotDir, manifestFileName))
+	assert.FileExists(t, filepath.Join(snapshotDir, blockFileArtifact))
+	assert.FileExists(t, filepath.Join(snapshotDir, pvtdataFileArtifact))
+
+	original, err := store.GetPvtDataAndBlockByNum(7, nil)
+	assert.NoError(t, err)
+
+	bootstrapProvider := NewProvider()
+	defer bootstrapProvider.Close()
+	bootstrapStore, ledgerID, height, err := bootstrapProvider.CreateFromSnapshot(snapshotDir)
+	assert.NoError(t, err)
+	defer bootstrapStore.Shutdown()
+	assert.Equal(t, "testLedger", ledgerID)
+	assert.Equal(t, uint64(8), height)
+
+	restored, err := bootstrapStore.GetPvtDataAndBlockByNum(7, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, original, restored)
+}
+
+// writeLegacyFixture simulates copying a pre-existing, already-on-disk v1.1/v1.2-mixed
+// ledger into place before the peer ever calls Provider.Open: it opens the exact on-disk
+// namespace (bookkeepingProvider + legacyDBSuffix) that Provider.Open will itself open later,
+// writing directly through leveldbhelper rather than through any legacyPvtdataStore/Provider
+// method, and closes its own provider handle before returning so Provider.Open doesn't race
+// it for the underlying LevelDB lock. The fixture has one v1.1-era entry (block 1, tx 1,
+// with ns-1/coll-1 and ns-1/coll-2 embedded together under a single key) and one v1.2-era
+// entry (block 2, tx 2, ns-1/coll-1 under its own composite key), simulating a ledger that
+// was upgraded from v1.1 to v1.2 mid-way through its life and never rewritten since
+func writeLegacyFixture(t *testing.T, ledgerID string) {
+	fixtureProvider := leveldbhelper.NewProvider(
+		&leveldbhelper.Conf{DBPath: ledgerconfig.GetInternalBookkeeperPath(bookkeepingDBName)})
+	defer fixtureProvider.Close()
+	db := fixtureProvider.GetDBHandle(ledgerID + legacyDBSuffix)
+
+	v11Payload, err := json.Marshal(v11Entry{
+		"ns-1": {
+			"coll-1": []byte("RandomBytes-v1.1-ns1-coll1"),
+			"coll-2": []byte("RandomBytes-v1.1-ns1-coll2"),
+		},
+	})
+	assert.NoError(t, err)
+
+	batch := leveldbhelper.NewUpdateBatch()
+	batch.Put(legacyV11Key(1, 1), v11Payload)
+	batch.Put(legacyV12Key(2, 2, "ns-1", "coll-1"), []byte("RandomBytes-v1.2-ns1-coll1"))
+	assert.NoError(t, db.WriteBatch(batch, true))
+}
+
+func TestReadMixedLegacyV11V12PvtData(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+
+	// seed the legacy fixture before Provider ever touches this ledger's bookkeeping
+	// directory, the same way a real pre-existing v1.1/v1.2 ledger would already be sitting
+	// on disk before an upgraded peer's Provider.Open runs against it for the first time
+	writeLegacyFixture(t, "testLedger")
+
+	provider := NewProvider()
+	defer provider.Close()
+
+	store, err := provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	// a v1.1-era block: both collections come back, decoded from the single embedded key
+	pvtdata, err := store.GetPvtDataByNum(1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pvtdata))
+	assert.Equal(t, uint64(1), pvtdata[0].SeqInBlock)
+	var collNames []string
+	for _, collRwset := range pvtdata[0].WriteSet.NsPvtRwset[0].CollectionPvtRwset {
+		collNames = append(collNames, collRwset.CollectionName)
+	}
+	assert.ElementsMatch(t, []string{"coll-1", "coll-2"}, collNames)
+
+	// a v1.2-era block: decoded from its composite key
+	pvtdata, err = store.GetPvtDataByNum(2, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pvtdata))
+	assert.Equal(t, uint64(2), pvtdata[0].SeqInBlock)
+	assert.Equal(t, "coll-1", pvtdata[0].WriteSet.NsPvtRwset[0].CollectionPvtRwset[0].CollectionName)
+
+	// now upgrade the ledger to pure v1.2/2.0 layout and verify both blocks still read back
+	// correctly, and that re-running the upgrade is a safe no-op
+	assert.NoError(t, provider.UpgradeFormat("testLedger"))
+	assert.NoError(t, provider.UpgradeFormat("testLedger"))
+
+	store.Shutdown()
+	store, err = provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	pvtdata, err = store.GetPvtDataByNum(1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pvtdata))
+	collNames = nil
+	for _, collRwset := range pvtdata[0].WriteSet.NsPvtRwset[0].CollectionPvtRwset {
+		collNames = append(collNames, collRwset.CollectionName)
+	}
+	assert.ElementsMatch(t, []string{"coll-1", "coll-2"}, collNames)
+
+	pvtdata, err = store.GetPvtDataByNum(2, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pvtdata))
+
+	marker, err := provider.bookkeepingProvider.GetDBHandle("testLedger" + legacyDBSuffix).Get([]byte(legacyFormatKey))
+	assert.NoError(t, err)
+	assert.Equal(t, legacyFormatV20, string(marker))
+}
+
+func TestUpgradeFormatIsIdempotentWithNoLegacyData(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProvider()
+	defer provider.Close()
+	store, err := provider.Open("testLedger")
+	assert.NoError(t, err)
+
+	sampleData := sampleData(t)
+	for _, sampleDatum := range sampleData {
+		assert.NoError(t, store.CommitWithPvtData(sampleDatum))
+	}
+	store.Shutdown()
+
+	// a freshly created store has no legacy-format data at all; upgrading it twice in a row
+	// must be a safe no-op and reads must keep working afterwards
+	assert.NoError(t, provider.UpgradeFormat("testLedger"))
+	assert.NoError(t, provider.UpgradeFormat("testLedger"))
+
+	store, err = provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+	pvtdata, err := store.GetPvtDataByNum(2, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(pvtdata))
+}
+
+func TestCachedBlockStoreConcurrentReads(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProvider()
+	defer provider.Close()
+	store, err := provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	store.BlockStore = NewCachedBlockStore(store.BlockStore, CacheConfig{MaxBlocks: 5, PrefetchWindow: 2})
+
+	sampleData := sampleData(t)
+	var wg sync.WaitGroup
+	for i, sampleDatum := range sampleData {
+		assert.NoError(t, store.CommitWithPvtData(sampleDatum))
+		for j := 0; j <= i; j++ {
+			wg.Add(1)
+			go func(blockNum uint64) {
+				defer wg.Done()
+				_, err := store.GetPvtDataAndBlockByNum(blockNum, nil)
+				assert.NoError(t, err)
+			}(uint64(j))
+		}
+	}
+	wg.Wait()
+
+	metrics := store.CacheMetrics()
+	assert.True(t, metrics.Hits > 0)
+}
+
+func TestCacheMetricsZeroValueWhenUncached(t *testing.T) {
+	testEnv := newTestEnv(t)
+	defer testEnv.cleanup()
+	provider := NewProvider()
+	defer provider.Close()
+	store, err := provider.Open("testLedger")
+	assert.NoError(t, err)
+	defer store.Shutdown()
+
+	assert.Equal(t, Metrics{}, store.CacheMetrics())
+}
+
 type slowBlockStore struct {
 	delay time.Duration
-	blkstorage.BlockStore
+	BlockStore
 }
 
-func newSlowBlockStore(store blkstorage.BlockStore, delay time.Duration) blkstorage.BlockStore {
+func newSlowBlockStore(store BlockStore, delay time.Duration) BlockStore {
 	return &slowBlockStore{
 		delay:      delay,
 		BlockStore: store,
@@ -258,3 +707,19 @@ func (bs *slowBlockStore) AddBlock(block *common.Block) error {
 	time.Sleep(bs.delay)
 	return bs.BlockStore.AddBlock(block)
 }
+
+type testEnv struct {
+	t        *testing.T
+	rootPath string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	rootPath := "/tmp/fabric/core/ledger/ledgerstorage"
+	viper.Set("peer.fileSystemPath", rootPath)
+	assert.NoError(t, os.RemoveAll(rootPath))
+	return &testEnv{t: t, rootPath: rootPath}
+}
+
+func (e *testEnv) cleanup() {
+	assert.NoError(e.t, os.RemoveAll(e.rootPath))
+}